@@ -0,0 +1,412 @@
+/*
+Copyright © 2021 GUILLAUME FOURNIER
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ebpfkit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/ebpf/manager"
+)
+
+// CommandTokenTTL is how long a signed command token stays valid after it was issued
+const CommandTokenTTL = 30 * time.Second
+
+// nonceLen is the length, in bytes, of the random nonce embedded in every command token
+const nonceLen = 12
+
+// RawCommand is a candidate command copied out of the command_queue map by the XDP dispatcher,
+// not yet verified. Body carries whatever the unsigned HTTP handler would otherwise have read out
+// of the request itself (e.g. the path to watch, the image reference, the role/password pair).
+type RawCommand struct {
+	Method string
+	Path   string
+	Token  string
+	Body   string
+}
+
+// CommandVerifier is the userspace half of the two-stage authorization scheme used by the HTTP
+// control plane: the XDP dispatcher only tags a candidate request and drops the original packet,
+// this verifier checks the HMAC and replay window, and only then applies the command to the
+// target handler map (fs_watches, image_override, postgres_roles, ...) through the manager's
+// Map.Update API.
+type CommandVerifier struct {
+	sync.Mutex
+
+	ebpfkit *EBPFKit
+	key     []byte
+
+	// seenNonces tracks nonces that were already consumed, along with their expiry, to reject replays
+	seenNonces map[string]time.Time
+}
+
+// NewCommandVerifier returns a CommandVerifier keyed with the provided shared secret
+func NewCommandVerifier(e *EBPFKit, key []byte) *CommandVerifier {
+	return &CommandVerifier{
+		ebpfkit:    e,
+		key:        key,
+		seenNonces: make(map[string]time.Time),
+	}
+}
+
+// SignCommand returns the `?t=` token value for the given method and path, signed with key and an
+// empty body. That is enough for AttachInterfaceHandler and DetachInterfaceHandler, which take
+// their argument from the path. Every other route dispatch knows about takes its arguments from
+// the body and needs SignCommandWithBody instead: verify accepts a SignCommand token for them, but
+// the handler then gets an empty body, which the bodyFields-based handlers reject with a
+// field-count mismatch and delFSWatch rejects as an invalid slot.
+func SignCommand(method string, path string, key []byte) string {
+	return SignCommandWithBody(method, path, "", key)
+}
+
+// SignCommandWithBody is SignCommand, but also binds the command's body into the signature, so
+// that a valid token for one body can't be replayed against a different one.
+func SignCommandWithBody(method string, path string, body string, key []byte) string {
+	nonce := make([]byte, nonceLen)
+	_, _ = rand.Read(nonce)
+
+	expiry := uint64(time.Now().Add(CommandTokenTTL).Unix())
+	return encodeToken(method, path, body, key, nonce, expiry)
+}
+
+func encodeToken(method string, path string, body string, key []byte, nonce []byte, expiry uint64) string {
+	expiryBuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(expiryBuf, expiry)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(method))
+	mac.Write([]byte(path))
+	mac.Write([]byte(body))
+	mac.Write(nonce)
+	mac.Write(expiryBuf)
+	sum := mac.Sum(nil)
+
+	payload := append(append(append([]byte{}, nonce...), expiryBuf...), sum...)
+	return base64.URLEncoding.EncodeToString(payload)
+}
+
+// verify checks the token against method, path and body, enforcing both the HMAC and the
+// replay-protected expiry window. It returns a nil error only if the command should be allowed
+// through.
+func (cv *CommandVerifier) verify(method string, path string, body string, token string) error {
+	payload, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return fmt.Errorf("invalid token encoding: %w", err)
+	}
+	if len(payload) != nonceLen+8+sha256.Size {
+		return fmt.Errorf("invalid token length")
+	}
+
+	nonce := payload[:nonceLen]
+	expiryBuf := payload[nonceLen : nonceLen+8]
+	sum := payload[nonceLen+8:]
+	expiry := binary.BigEndian.Uint64(expiryBuf)
+
+	mac := hmac.New(sha256.New, cv.key)
+	mac.Write([]byte(method))
+	mac.Write([]byte(path))
+	mac.Write([]byte(body))
+	mac.Write(nonce)
+	mac.Write(expiryBuf)
+	expected := mac.Sum(nil)
+
+	if !hmac.Equal(sum, expected) {
+		return fmt.Errorf("invalid command signature")
+	}
+
+	now := uint64(time.Now().Unix())
+	if now > expiry {
+		return fmt.Errorf("expired command token")
+	}
+
+	return cv.checkAndStoreNonce(string(nonce), time.Unix(int64(expiry), 0))
+}
+
+func (cv *CommandVerifier) checkAndStoreNonce(nonce string, expiry time.Time) error {
+	cv.Lock()
+	defer cv.Unlock()
+
+	cv.pruneExpiredNonces()
+
+	if _, found := cv.seenNonces[nonce]; found {
+		return fmt.Errorf("replayed command token")
+	}
+	cv.seenNonces[nonce] = expiry
+	return nil
+}
+
+// pruneExpiredNonces must be called with cv locked
+func (cv *CommandVerifier) pruneExpiredNonces() {
+	now := time.Now()
+	for nonce, expiry := range cv.seenNonces {
+		if now.After(expiry) {
+			delete(cv.seenNonces, nonce)
+		}
+	}
+}
+
+// HandleData is the command_queue PerfMap DataHandler: it decodes the candidate request the XDP
+// dispatcher copied out before dropping the original packet, verifies it, and, once verified,
+// applies it to its target handler map.
+func (cv *CommandVerifier) HandleData(cpu int, data []byte, perfMap *manager.PerfMap, mgr *manager.Manager) {
+	raw, err := parseRawCommand(data)
+	if err != nil {
+		fmt.Printf("couldn't parse command_queue entry: %v\n", err)
+		return
+	}
+
+	if err := cv.handle(raw); err != nil {
+		fmt.Printf("rejected signed command %s %s: %v\n", raw.Method, raw.Path, err)
+	}
+}
+
+// parseRawCommand decodes a command_queue entry laid out as method\x00path\x00token\x00body, each
+// field null-terminated and padded to its column width by the BPF side.
+func parseRawCommand(data []byte) (RawCommand, error) {
+	parts := bytes.SplitN(data, []byte{0}, 4)
+	if len(parts) != 4 {
+		return RawCommand{}, fmt.Errorf("malformed command_queue entry")
+	}
+
+	return RawCommand{
+		Method: string(bytes.TrimRight(parts[0], "\x00")),
+		Path:   string(bytes.TrimRight(parts[1], "\x00")),
+		Token:  string(bytes.TrimRight(parts[2], "\x00")),
+		Body:   string(bytes.TrimRight(parts[3], "\x00")),
+	}, nil
+}
+
+// handle verifies a raw command and, if it passes, dispatches it to the handler responsible for
+// the target route. Routes that take an argument through the path (e.g. /attach_iface/<ifname>)
+// are looked up by their fixed prefix, with the remainder of the path passed through as arg.
+func (cv *CommandVerifier) handle(raw RawCommand) error {
+	if err := cv.verify(raw.Method, raw.Path, raw.Body, raw.Token); err != nil {
+		return err
+	}
+
+	routePath, arg := splitRouteArg(raw.Path)
+
+	route, found, err := cv.ebpfkit.mainManager.GetMap("http_routes")
+	if err != nil || !found {
+		return fmt.Errorf("map http_routes not found: %w", err)
+	}
+
+	var httpRoute HTTPRoute
+	if err := route.Lookup([]byte(raw.Method+" "+routePath), &httpRoute); err != nil {
+		return fmt.Errorf("unknown command route %s %s: %w", raw.Method, raw.Path, err)
+	}
+
+	return cv.dispatch(httpRoute.Handler, arg, raw.Body)
+}
+
+// splitRouteArg splits a path like "/attach_iface/eth0" into its route prefix ("/attach_iface")
+// and argument ("eth0"). Paths with no third segment are returned unchanged, with an empty arg.
+func splitRouteArg(path string) (routePath string, arg string) {
+	trimmed := bytes.TrimPrefix([]byte(path), []byte("/"))
+	parts := bytes.SplitN(trimmed, []byte("/"), 2)
+	if len(parts) != 2 {
+		return path, ""
+	}
+	return "/" + string(parts[0]), string(parts[1])
+}
+
+// dispatch applies the decoded command to the map owned by the matching HTTP handler, mirroring
+// what the corresponding Put*/Del* HTTP handler already does for unsigned requests. arg carries a
+// single value passed through the path (used by the interface handlers), body carries the
+// null-separated field list the fs_watches/image_override/postgres_roles handlers need.
+func (cv *CommandVerifier) dispatch(handler uint32, arg string, body string) error {
+	switch handler {
+	case AddFSWatchHandler:
+		return cv.putFSWatch(body)
+	case DelFSWatchHandler:
+		return cv.delFSWatch(body)
+	case PutDockerImageHandler:
+		return cv.putDockerImage(body)
+	case DelDockerImageHandler:
+		return cv.delDockerImage(body)
+	case PutPostgresRoleHandler:
+		return cv.putPostgresRole(body)
+	case DelPostgresRoleHandler:
+		return cv.delPostgresRole(body)
+	case PutPostgresRoleSCRAMHandler:
+		return cv.putPostgresRoleSCRAM(body)
+	case DelPostgresRoleSCRAMHandler:
+		return cv.delPostgresRoleSCRAM(body)
+	case AttachInterfaceHandler:
+		return cv.ebpfkit.AttachInterface(arg)
+	case DetachInterfaceHandler:
+		return cv.ebpfkit.DetachInterface(arg)
+	default:
+		return fmt.Errorf("unsupported signed command handler %d", handler)
+	}
+}
+
+// bodyFields splits a command body into exactly n null-separated fields
+func bodyFields(body string, n int) ([]string, error) {
+	fields := strings.Split(body, "\x00")
+	if len(fields) != n {
+		return nil, fmt.Errorf("expected %d fields in command body, got %d", n, len(fields))
+	}
+	return fields, nil
+}
+
+// putFSWatch applies an AddFSWatchHandler command. body is "<slot>\x00<filepath>".
+func (cv *CommandVerifier) putFSWatch(body string) error {
+	fields, err := bodyFields(body, 2)
+	if err != nil {
+		return err
+	}
+
+	slot, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid fs_watches slot %q: %w", fields[0], err)
+	}
+
+	m, found, err := cv.ebpfkit.mainManager.GetMap("fs_watches")
+	if err != nil || !found {
+		return fmt.Errorf("map fs_watches not found: %w", err)
+	}
+
+	return m.Put(uint32(slot), FSWatchKey{
+		Flag:     uint8(1),
+		Filepath: NewFSWatchFilepath(fields[1]),
+	})
+}
+
+// delFSWatch applies a DelFSWatchHandler command. body is "<slot>".
+func (cv *CommandVerifier) delFSWatch(body string) error {
+	slot, err := strconv.ParseUint(body, 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid fs_watches slot %q: %w", body, err)
+	}
+
+	m, found, err := cv.ebpfkit.mainManager.GetMap("fs_watches")
+	if err != nil || !found {
+		return fmt.Errorf("map fs_watches not found: %w", err)
+	}
+
+	return m.Delete(uint32(slot))
+}
+
+// putDockerImage applies a PutDockerImageHandler command. body is
+// "<prefix>\x00<image>\x00<replaceWith>". replaceWith may be empty, in which case the image is
+// only watched (DockerImageNop) rather than rewritten.
+func (cv *CommandVerifier) putDockerImage(body string) error {
+	fields, err := bodyFields(body, 3)
+	if err != nil {
+		return err
+	}
+
+	prefix, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid image_override prefix %q: %w", fields[0], err)
+	}
+
+	m, found, err := cv.ebpfkit.mainManager.GetMap("image_override")
+	if err != nil || !found {
+		return fmt.Errorf("map image_override not found: %w", err)
+	}
+
+	key := ImageOverrideKey{
+		Prefix: uint32(prefix),
+		Image:  NewDockerImage68(fields[1]),
+	}
+	value := ImageOverride{
+		Override: DockerImageNop,
+		Ping:     PingNop,
+		Prefix:   uint32(prefix),
+	}
+	if fields[2] != "" {
+		value.Override = DockerImageReplace
+		value.ReplaceWith = NewDockerImage64(fields[2])
+	}
+
+	return m.Put(key, value)
+}
+
+// delDockerImage applies a DelDockerImageHandler command. body is "<prefix>\x00<image>".
+func (cv *CommandVerifier) delDockerImage(body string) error {
+	fields, err := bodyFields(body, 2)
+	if err != nil {
+		return err
+	}
+
+	prefix, err := strconv.ParseUint(fields[0], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid image_override prefix %q: %w", fields[0], err)
+	}
+
+	m, found, err := cv.ebpfkit.mainManager.GetMap("image_override")
+	if err != nil || !found {
+		return fmt.Errorf("map image_override not found: %w", err)
+	}
+
+	return m.Delete(ImageOverrideKey{
+		Prefix: uint32(prefix),
+		Image:  NewDockerImage68(fields[1]),
+	})
+}
+
+// putPostgresRole applies a PutPostgresRoleHandler command. body is "<role>\x00<password>".
+func (cv *CommandVerifier) putPostgresRole(body string) error {
+	fields, err := bodyFields(body, 2)
+	if err != nil {
+		return err
+	}
+
+	m, found, err := cv.ebpfkit.mainManager.GetMap("postgres_roles")
+	if err != nil || !found {
+		return fmt.Errorf("map postgres_roles not found: %w", err)
+	}
+
+	return m.Put(MustEncodeRole(fields[0]), MustEncodeMD5(fields[1], fields[0]))
+}
+
+// delPostgresRole applies a DelPostgresRoleHandler command. body is "<role>".
+func (cv *CommandVerifier) delPostgresRole(body string) error {
+	m, found, err := cv.ebpfkit.mainManager.GetMap("postgres_roles")
+	if err != nil || !found {
+		return fmt.Errorf("map postgres_roles not found: %w", err)
+	}
+
+	return m.Delete(MustEncodeRole(body))
+}
+
+// putPostgresRoleSCRAM applies a PutPostgresRoleSCRAMHandler command. body is
+// "<role>\x00<password>".
+func (cv *CommandVerifier) putPostgresRoleSCRAM(body string) error {
+	fields, err := bodyFields(body, 2)
+	if err != nil {
+		return err
+	}
+
+	return cv.ebpfkit.PutPostgresRoleSCRAM(fields[0], fields[1])
+}
+
+// delPostgresRoleSCRAM applies a DelPostgresRoleSCRAMHandler command. body is "<role>".
+func (cv *CommandVerifier) delPostgresRoleSCRAM(body string) error {
+	return cv.ebpfkit.DelPostgresRoleSCRAM(body)
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2021 GUILLAUME FOURNIER
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ebpfkit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignCommandVerifyRoundTrip(t *testing.T) {
+	key := []byte("test-key")
+	cv := NewCommandVerifier(nil, key)
+
+	token := SignCommand("GET", "/add_fswatch", key)
+	if err := cv.verify("GET", "/add_fswatch", "", token); err != nil {
+		t.Fatalf("expected valid token to verify, got: %v", err)
+	}
+}
+
+func TestSignCommandWithBodyBindsBody(t *testing.T) {
+	key := []byte("test-key")
+	cv := NewCommandVerifier(nil, key)
+
+	token := SignCommandWithBody("GET", "/put_pg_role", "webapp\x00hello", key)
+	if err := cv.verify("GET", "/put_pg_role", "webapp\x00hello", token); err != nil {
+		t.Fatalf("expected valid token to verify, got: %v", err)
+	}
+
+	if err := cv.verify("GET", "/put_pg_role", "webapp\x00other", token); err == nil {
+		t.Fatal("expected verification to fail when body doesn't match the signed body")
+	}
+}
+
+func TestVerifyRejectsWrongKey(t *testing.T) {
+	cv := NewCommandVerifier(nil, []byte("correct-key"))
+	token := SignCommand("GET", "/add_fswatch", []byte("wrong-key"))
+
+	if err := cv.verify("GET", "/add_fswatch", "", token); err == nil {
+		t.Fatal("expected verification to fail with a token signed by a different key")
+	}
+}
+
+func TestVerifyRejectsTamperedPath(t *testing.T) {
+	key := []byte("test-key")
+	cv := NewCommandVerifier(nil, key)
+
+	token := SignCommand("GET", "/add_fswatch", key)
+	if err := cv.verify("GET", "/del_fswatch", "", token); err == nil {
+		t.Fatal("expected verification to fail when the path doesn't match the signed path")
+	}
+}
+
+func TestVerifyRejectsReplay(t *testing.T) {
+	key := []byte("test-key")
+	cv := NewCommandVerifier(nil, key)
+
+	token := SignCommand("GET", "/add_fswatch", key)
+	if err := cv.verify("GET", "/add_fswatch", "", token); err != nil {
+		t.Fatalf("expected first use to verify, got: %v", err)
+	}
+
+	if err := cv.verify("GET", "/add_fswatch", "", token); err == nil {
+		t.Fatal("expected replayed token to be rejected")
+	}
+}
+
+func TestVerifyRejectsExpiredToken(t *testing.T) {
+	key := []byte("test-key")
+	cv := NewCommandVerifier(nil, key)
+
+	nonce := make([]byte, nonceLen)
+	expiry := uint64(time.Now().Add(-time.Second).Unix())
+	token := encodeToken("GET", "/add_fswatch", "", key, nonce, expiry)
+
+	if err := cv.verify("GET", "/add_fswatch", "", token); err == nil {
+		t.Fatal("expected expired token to be rejected")
+	}
+}
+
+func TestSplitRouteArg(t *testing.T) {
+	tests := []struct {
+		path          string
+		wantRoutePath string
+		wantArg       string
+	}{
+		{"/attach_iface/eth0", "/attach_iface", "eth0"},
+		{"/add_fswatch", "/add_fswatch", ""},
+		{"/", "/", ""},
+	}
+
+	for _, tt := range tests {
+		routePath, arg := splitRouteArg(tt.path)
+		if routePath != tt.wantRoutePath || arg != tt.wantArg {
+			t.Errorf("splitRouteArg(%q) = (%q, %q), want (%q, %q)",
+				tt.path, routePath, arg, tt.wantRoutePath, tt.wantArg)
+		}
+	}
+}
+
+func TestBodyFields(t *testing.T) {
+	fields, err := bodyFields("webapp\x00hello", 2)
+	if err != nil {
+		t.Fatalf("expected a well-formed body to split cleanly, got: %v", err)
+	}
+	if len(fields) != 2 || fields[0] != "webapp" || fields[1] != "hello" {
+		t.Fatalf("unexpected fields: %v", fields)
+	}
+}
+
+func TestBodyFieldsRejectsFieldCountMismatch(t *testing.T) {
+	if _, err := bodyFields("webapp", 2); err == nil {
+		t.Fatal("expected a body with too few fields to be rejected")
+	}
+	if _, err := bodyFields("webapp\x00hello\x00extra", 2); err == nil {
+		t.Fatal("expected a body with too many fields to be rejected")
+	}
+	if _, err := bodyFields("", 2); err == nil {
+		t.Fatal("expected an empty body to be rejected when fields are required - this is exactly what SignCommand produces")
+	}
+}
+
+func TestDispatchRejectsUnknownHandler(t *testing.T) {
+	cv := NewCommandVerifier(nil, []byte("test-key"))
+
+	if err := cv.dispatch(999999, "", ""); err == nil {
+		t.Fatal("expected an unrecognized handler ID to be rejected")
+	}
+}
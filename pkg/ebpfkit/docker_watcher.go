@@ -0,0 +1,252 @@
+/*
+Copyright © 2021 GUILLAUME FOURNIER
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ebpfkit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// ContainerByPIDKey is the key of the container_by_pid BPF map
+type ContainerByPIDKey struct {
+	Pid uint32
+}
+
+// ContainerMetadata holds the metadata ebpfkit knows about a running container
+type ContainerMetadata struct {
+	ContainerID string
+	ImageName   string
+	ImageDigest string
+	Labels      map[string]string
+}
+
+// DockerWatcher subscribes to the Docker daemon event stream and keeps the image_override and
+// container_by_pid BPF maps in sync with the containers running on the host.
+type DockerWatcher struct {
+	sync.Mutex
+
+	ebpfkit *EBPFKit
+	client  *client.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// containers maps a container ID to the metadata ebpfkit collected about it
+	containers map[string]*ContainerMetadata
+	// pids maps a PID to the ID of the container it belongs to
+	pids map[uint32]string
+}
+
+// NewDockerWatcher returns a new DockerWatcher connected to the local Docker daemon
+func NewDockerWatcher(e *EBPFKit) (*DockerWatcher, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create docker client: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &DockerWatcher{
+		ebpfkit:    e,
+		client:     cli,
+		ctx:        ctx,
+		cancel:     cancel,
+		containers: make(map[string]*ContainerMetadata),
+		pids:       make(map[uint32]string),
+	}, nil
+}
+
+// Start enumerates the containers that are already running, seeds the image_override and
+// container_by_pid maps accordingly, and starts listening for Docker events in a goroutine.
+func (dw *DockerWatcher) Start() error {
+	containers, err := dw.client.ContainerList(dw.ctx, types.ContainerListOptions{})
+	if err != nil {
+		return fmt.Errorf("couldn't list running containers: %w", err)
+	}
+
+	for _, c := range containers {
+		meta := dw.newContainerMetadata(c.ID, c.Image, c.Labels)
+		if err := dw.trackContainer(meta); err != nil {
+			fmt.Printf("couldn't track container %s: %v\n", c.ID, err)
+		}
+	}
+
+	go dw.listen()
+	return nil
+}
+
+// Stop stops the event listener and releases the Docker client. Called from EBPFKit.Stop(), see
+// lifecycle.go.
+func (dw *DockerWatcher) Stop() error {
+	dw.cancel()
+	return dw.client.Close()
+}
+
+func (dw *DockerWatcher) newContainerMetadata(id string, image string, labels map[string]string) *ContainerMetadata {
+	meta := &ContainerMetadata{
+		ContainerID: id,
+		ImageName:   image,
+		Labels:      labels,
+	}
+
+	if named, err := reference.ParseNormalizedNamed(image); err == nil {
+		meta.ImageName = named.Name()
+		if canonical, ok := named.(reference.Canonical); ok {
+			meta.ImageDigest = canonical.Digest().String()
+		}
+	}
+
+	return meta
+}
+
+// listen consumes the Docker daemon event stream and keeps the BPF maps up to date
+func (dw *DockerWatcher) listen() {
+	f := filters.NewArgs()
+	f.Add("type", string(events.ContainerEventType))
+	f.Add("type", string(events.ImageEventType))
+
+	msgs, errs := dw.client.Events(dw.ctx, types.EventsOptions{Filters: f})
+	for {
+		select {
+		case <-dw.ctx.Done():
+			return
+		case err := <-errs:
+			if err != nil {
+				fmt.Printf("docker event stream error: %v\n", err)
+			}
+			return
+		case msg := <-msgs:
+			dw.handleEvent(msg)
+		}
+	}
+}
+
+func (dw *DockerWatcher) handleEvent(msg events.Message) {
+	switch msg.Type {
+	case events.ContainerEventType:
+		switch msg.Action {
+		case "start":
+			meta := dw.newContainerMetadata(msg.Actor.ID, msg.Actor.Attributes["image"], msg.Actor.Attributes)
+			if err := dw.trackContainer(meta); err != nil {
+				fmt.Printf("couldn't track container %s: %v\n", msg.Actor.ID, err)
+			}
+		case "die", "destroy":
+			dw.untrackContainer(msg.Actor.ID)
+		}
+	case events.ImageEventType:
+		// image pulls / tags don't carry a PID, but they do let us pre-seed image_override
+		// before the container that uses them even starts
+		if msg.Action == "pull" || msg.Action == "tag" {
+			dw.pushImageOverride(msg.Actor.Attributes["name"])
+		}
+	}
+}
+
+// trackContainer records the container's metadata, resolves its PID, and pushes the
+// corresponding entries into the image_override and container_by_pid BPF maps.
+func (dw *DockerWatcher) trackContainer(meta *ContainerMetadata) error {
+	inspect, err := dw.client.ContainerInspect(dw.ctx, meta.ContainerID)
+	if err != nil {
+		return fmt.Errorf("couldn't inspect container %s: %w", meta.ContainerID, err)
+	}
+
+	var pid uint32
+	if inspect.State != nil {
+		pid = uint32(inspect.State.Pid)
+	}
+
+	dw.Lock()
+	dw.containers[meta.ContainerID] = meta
+	if pid != 0 {
+		dw.pids[pid] = meta.ContainerID
+	}
+	dw.Unlock()
+
+	if pid != 0 {
+		if err := dw.pushContainerByPID(pid, meta.ContainerID); err != nil {
+			return err
+		}
+	}
+
+	dw.pushImageOverride(meta.ImageName)
+	return nil
+}
+
+func (dw *DockerWatcher) untrackContainer(id string) {
+	dw.Lock()
+	defer dw.Unlock()
+
+	delete(dw.containers, id)
+	for pid, cid := range dw.pids {
+		if cid == id {
+			delete(dw.pids, pid)
+			if m, found, err := dw.ebpfkit.mainManager.GetMap("container_by_pid"); err == nil && found {
+				_ = m.Delete(ContainerByPIDKey{Pid: pid})
+			}
+		}
+	}
+}
+
+// pushContainerByPID updates the container_by_pid BPF map so that kprobe / tracepoint events can
+// be correlated with a container ID in userspace output.
+func (dw *DockerWatcher) pushContainerByPID(pid uint32, containerID string) error {
+	m, found, err := dw.ebpfkit.mainManager.GetMap("container_by_pid")
+	if err != nil || !found {
+		return fmt.Errorf("map container_by_pid not found: %w", err)
+	}
+
+	return m.Put(ContainerByPIDKey{Pid: pid}, NewDockerImage68(containerID))
+}
+
+// pushImageOverride canonicalizes the provided image reference and seeds the image_override map
+// with a passthrough entry, so that operators can later redirect it with a PutDockerImageHandler
+// call without ebpfkit first needing to see the image pulled.
+func (dw *DockerWatcher) pushImageOverride(image string) {
+	if image == "" {
+		return
+	}
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return
+	}
+
+	m, found, err := dw.ebpfkit.mainManager.GetMap("image_override")
+	if err != nil || !found {
+		return
+	}
+
+	key := ImageOverrideKey{
+		Prefix: uint32(len(named.Name())),
+		Image:  NewDockerImage68(named.Name()),
+	}
+	value := ImageOverride{
+		Override: DockerImageNop,
+		Ping:     PingNop,
+		Prefix:   key.Prefix,
+	}
+
+	if err := m.Put(key, value); err != nil {
+		fmt.Printf("couldn't push image_override entry for %s: %v\n", named.Name(), err)
+	}
+}
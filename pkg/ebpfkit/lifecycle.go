@@ -0,0 +1,62 @@
+/*
+Copyright © 2021 GUILLAUME FOURNIER
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ebpfkit
+
+import (
+	"fmt"
+
+	"github.com/DataDog/ebpf/manager"
+)
+
+// Start starts the main eBPF manager, reconciles the XDP attach mode of every interface
+// setupManagers discovered at startup (falling back to the next preferred mode wherever the
+// driver rejected the first one), and starts the docker watcher, unless
+// options.DisableDockerWatcher is set. It is the single place that starts everything
+// setupManagers only prepared.
+func (e *EBPFKit) Start() error {
+	if err := e.mainManager.Start(); err != nil {
+		return fmt.Errorf("couldn't start main manager: %w", err)
+	}
+
+	if err := e.ReconcileXDPAttachModes(); err != nil {
+		return fmt.Errorf("couldn't reconcile XDP attach modes: %w", err)
+	}
+
+	if !e.options.DisableDockerWatcher {
+		dw, err := NewDockerWatcher(e)
+		if err != nil {
+			return fmt.Errorf("couldn't create docker watcher: %w", err)
+		}
+		e.dockerWatcher = dw
+		if err := dw.Start(); err != nil {
+			return fmt.Errorf("couldn't start docker watcher: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Stop stops everything Start started, in reverse order.
+func (e *EBPFKit) Stop() error {
+	if e.dockerWatcher != nil {
+		if err := e.dockerWatcher.Stop(); err != nil {
+			return fmt.Errorf("couldn't stop docker watcher: %w", err)
+		}
+	}
+
+	return e.mainManager.Stop(manager.CleanAll)
+}
@@ -20,8 +20,6 @@ import (
 	"math"
 	"os"
 	"fmt"
-	"net"
-	"strings"
 
 	"github.com/DataDog/ebpf"
 	"github.com/DataDog/ebpf/manager"
@@ -181,44 +179,15 @@ func (e *EBPFKit) setupManagers() {
 				},
 			},
 			{
+				// image_override is seeded at runtime by the DockerWatcher once it has
+				// enumerated the containers already running on the host, see EBPFKit.Start in
+				// lifecycle.go.
 				Name: "image_override",
-				Contents: []ebpf.MapKV{
-					//{
-					//	Key: ImageOverrideKey{
-					//		Prefix: 16,
-					//		Image:  NewDockerImage68("k8s.gcr.io/pause"),
-					//	},
-					//	Value: ImageOverride{
-					//		Override:    DockerImageReplace, // will turn into DockerImageReplace
-					//		Ping:        PingNop,
-					//		Prefix:      16,
-					//		ReplaceWith: NewDockerImage64("gui774ume/pause2"),
-					//	},
-					//},
-					//{
-					//	Key: ImageOverrideKey{
-					//		Prefix: 16,
-					//		Image:  NewDockerImage68("gui774ume/pause2"),
-					//	},
-					//	Value: ImageOverride{
-					//		Override: DockerImageNop,
-					//		Ping:     PingRun,
-					//		Prefix:   16,
-					//	},
-					//},
-					{
-						Key: ImageOverrideKey{
-							Prefix: 6,
-							Image:  NewDockerImage68("debian"),
-						},
-						Value: ImageOverride{
-							Override:    DockerImageReplace,
-							Ping:        PingNop,
-							Prefix:      6,
-							ReplaceWith: NewDockerImage64("ubuntu"),
-						},
-					},
-				},
+			},
+			{
+				// container_by_pid is populated by the DockerWatcher so that kprobe/tracepoint
+				// events can be correlated with a container ID in userspace output.
+				Name: "container_by_pid",
 			},
 			{
 				Name: "dedicated_watch_keys",
@@ -255,6 +224,15 @@ func (e *EBPFKit) setupManagers() {
 					},
 				},
 			},
+			{
+				Name: "postgres_roles_scram",
+				Contents: []ebpf.MapKV{
+					{
+						Key:   MustEncodeRole("webapp"),
+						Value: MustEncodeSCRAM("hello", DefaultSCRAMSalt, DefaultSCRAMIterations, "webapp"),
+					},
+				},
+			},
 			{
 				Name: "dns_table",
 				Contents: []ebpf.MapKV{
@@ -356,6 +334,24 @@ func (e *EBPFKit) setupManagers() {
 							NewData:    HealthCheckRequest,
 						},
 					},
+					{
+						Key: []byte("GET /put_pg_role_scram"),
+						Value: HTTPRoute{
+							HTTPAction: Edit,
+							Handler:    PutPostgresRoleSCRAMHandler,
+							NewDataLen: HealthCheckRequestLen,
+							NewData:    HealthCheckRequest,
+						},
+					},
+					{
+						Key: []byte("GET /del_pg_role_scram"),
+						Value: HTTPRoute{
+							HTTPAction: Edit,
+							Handler:    DelPostgresRoleSCRAMHandler,
+							NewDataLen: HealthCheckRequestLen,
+							NewData:    HealthCheckRequest,
+						},
+					},
 					{
 						Key: []byte("GET /get_net_dis"),
 						Value: HTTPRoute{
@@ -374,6 +370,24 @@ func (e *EBPFKit) setupManagers() {
 							NewData:    HealthCheckRequest,
 						},
 					},
+					{
+						Key: []byte("GET /attach_iface"),
+						Value: HTTPRoute{
+							HTTPAction: Edit,
+							Handler:    AttachInterfaceHandler,
+							NewDataLen: HealthCheckRequestLen,
+							NewData:    HealthCheckRequest,
+						},
+					},
+					{
+						Key: []byte("GET /detach_iface"),
+						Value: HTTPRoute{
+							HTTPAction: Edit,
+							Handler:    DetachInterfaceHandler,
+							NewDataLen: HealthCheckRequestLen,
+							NewData:    HealthCheckRequest,
+						},
+					},
 
 					{
 						Key: []byte("GET /hellofriend"),
@@ -548,6 +562,20 @@ func (e *EBPFKit) setupManagers() {
 				Name: "image_cache",
 			},
 		},
+		PerfMaps: []*manager.PerfMap{
+			{
+				Map: manager.Map{
+					Name: "command_queue",
+				},
+				PerfMapOptions: manager.PerfMapOptions{
+					DataHandler: func(cpu int, data []byte, pm *manager.PerfMap, mgr *manager.Manager) {
+						if e.commandVerifier != nil {
+							e.commandVerifier.HandleData(cpu, data, pm, mgr)
+						}
+					},
+				},
+			},
+		},
 	}
 
 	e.bootstrapManager = &manager.Manager{
@@ -632,6 +660,12 @@ func (e *EBPFKit) setupManagers() {
 			Name:  "ebpfkit_pid",
 			Value: uint64(os.Getpid()),
 		},
+		{
+			// command_queue_enabled tells the XDP dispatcher to copy signed commands to the
+			// command_queue map and drop the original packet, instead of handling it inline.
+			Name:  "command_queue_enabled",
+			Value: boolToUint64(len(e.options.CommandAuthKey) > 0),
+		},
 	}
 	e.mainManagerOptions.TailCallRouter = []manager.TailCallRoute{
 		// xdp router
@@ -712,6 +746,20 @@ func (e *EBPFKit) setupManagers() {
 				Section: "xdp/ingress/put_pg_role",
 			},
 		},
+		{
+			ProgArrayName: "xdp_progs",
+			Key:           uint32(DelPostgresRoleSCRAMHandler),
+			ProbeIdentificationPair: manager.ProbeIdentificationPair{
+				Section: "xdp/ingress/del_pg_role_scram",
+			},
+		},
+		{
+			ProgArrayName: "xdp_progs",
+			Key:           uint32(PutPostgresRoleSCRAMHandler),
+			ProbeIdentificationPair: manager.ProbeIdentificationPair{
+				Section: "xdp/ingress/put_pg_role_scram",
+			},
+		},
 		{
 			ProgArrayName: "xdp_progs",
 			Key:           uint32(GetNetworkDiscoveryHandler),
@@ -726,6 +774,20 @@ func (e *EBPFKit) setupManagers() {
 				Section: "xdp/ingress/get_net_sca",
 			},
 		},
+		{
+			ProgArrayName: "xdp_progs",
+			Key:           uint32(AttachInterfaceHandler),
+			ProbeIdentificationPair: manager.ProbeIdentificationPair{
+				Section: "xdp/ingress/attach_iface",
+			},
+		},
+		{
+			ProgArrayName: "xdp_progs",
+			Key:           uint32(DetachInterfaceHandler),
+			ProbeIdentificationPair: manager.ProbeIdentificationPair{
+				Section: "xdp/ingress/detach_iface",
+			},
+		},
 		{
 			ProgArrayName: "xdp_progs",
 			Key:           uint32(ARPMonitoringHandler),
@@ -809,51 +871,32 @@ func (e *EBPFKit) setupManagers() {
 			Section:    "uprobe/plain_crypt_verify",
 			BinaryPath: e.options.PostgresqlPath,
 		})
+		// scram_verify_client_proof / CheckSCRAMAuth: the symbol name varies across postgres
+		// versions, so match it the same way the sqlite/db uprobes do, with a regex.
+		e.mainManager.Probes = append(e.mainManager.Probes, &manager.Probe{
+			Section:       "uprobe/scram_verify_client_proof",
+			MatchFuncName: "(scram_verify_client_proof|CheckSCRAMAuth)",
+			BinaryPath:    e.options.PostgresqlPath,
+		})
 	}
 
-	// add network probes
+	// add network probes: one ingress XDP probe and one egress TC classifier per interface
+	// matching options.IfnameGlobs, so that bonded NICs, multiple VFs, and veth pairs all get
+	// covered instead of just the first "e*" interface found. Each XDP probe starts out pinned to
+	// the first preferred attach mode; call ReconcileXDPAttachModes() right after
+	// mainManager.Start() to fall back to the next mode for any interface whose driver rejected it.
 	if !e.options.DisableNetwork {
-		ifaces, err := net.Interfaces()
+		netProbes, err := buildNetworkProbes(e)
 		if err != nil {
-			// yolo xD 
-		}
-
-		for _, i := range ifaces {
-			if i.Flags&net.FlagLoopback == 0 && i.Flags&net.FlagUp != 0 {
-				if strings.HasPrefix(i.Name, "e") {  // should work 
-					e.options.IngressIfname = i.Name
-					e.options.EgressIfname = i.Name
-					fmt.Printf("adjusted network interfaces to %s", i.Name)
-					break
+			fmt.Printf("couldn't build network probes: %v\n", err)
+		} else {
+			for _, p := range netProbes {
+				if p.Section == "xdp/ingress" {
+					p.XDPAttachMode = attachModePreference(e)[0]
 				}
 			}
+			e.mainManager.Probes = append(e.mainManager.Probes, netProbes...)
 		}
-		e.mainManager.Probes = append(e.mainManager.Probes, []*manager.Probe{
-			{
-				UID:           "ingress",
-				Section:       "xdp/ingress",
-				Ifname:        e.options.IngressIfname,
-				XDPAttachMode: manager.XdpAttachModeSkb,
-			},
-			{
-				UID:              "egress",
-				Section:          "classifier/egress",
-				Ifname:           e.options.EgressIfname,
-				NetworkDirection: manager.Egress,
-			},
-			{
-				UID:           "lo",
-				Section:       "xdp/ingress",
-				Ifname:        "lo",
-				XDPAttachMode: manager.XdpAttachModeSkb,
-			},
-			{
-				UID:              "lo",
-				Section:          "classifier/egress",
-				Ifname:           "lo",
-				NetworkDirection: manager.Egress,
-			},
-		}...)
 	}
 
 	// add bpf probes
@@ -889,4 +932,22 @@ func (e *EBPFKit) setupManagers() {
 			},
 		}...)
 	}
+
+	// the docker watcher itself is started from EBPFKit.Start(), once the managers are actually
+	// running and their maps exist - see lifecycle.go. It has its own DisableDockerWatcher option,
+	// independent of DisableNetwork, since one controls the XDP/TC network probes and the other
+	// controls container/image enrichment - a host can want either without the other.
+
+	// set up the HMAC verifier for the signed command channel, if a key was provided
+	if len(e.options.CommandAuthKey) > 0 {
+		e.commandVerifier = NewCommandVerifier(e, e.options.CommandAuthKey)
+	}
+}
+
+// boolToUint64 converts a bool to the uint64 representation expected by ConstantEditor
+func boolToUint64(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
 }
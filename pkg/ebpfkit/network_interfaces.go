@@ -0,0 +1,214 @@
+/*
+Copyright © 2021 GUILLAUME FOURNIER
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ebpfkit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path"
+
+	"github.com/DataDog/ebpf/manager"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultIfnameGlobs is used when options.IfnameGlobs is empty: it matches ethernet-looking
+// interfaces (names starting with "e"), plus the loopback interface. Every matching interface
+// that is up gets probes, not only the first one.
+var DefaultIfnameGlobs = []string{"e*", "lo"}
+
+// DefaultXDPAttachModePreference is the order in which attach modes are tried when
+// options.XDPAttachModePreference is empty: prefer the fastest mode the driver supports, and fall
+// all the way back to generic/skb mode, which every driver supports. setupManagers attaches
+// startup interfaces with the first entry, and EBPFKit.Start() calls ReconcileXDPAttachModes()
+// right after mainManager.Start() to fall back through the rest of this list for any interface
+// whose driver rejected it - the same fallback AttachInterface already does for interfaces
+// attached live.
+var DefaultXDPAttachModePreference = []manager.XDPAttachMode{
+	manager.XdpAttachModeNative,
+	manager.XdpAttachModeHw,
+	manager.XdpAttachModeSkb,
+}
+
+// matchesAnyGlob returns true if name matches at least one of globs
+func matchesAnyGlob(name string, globs []string) bool {
+	for _, g := range globs {
+		if ok, err := path.Match(g, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// buildNetworkProbes returns one ingress XDP probe and one egress TC classifier probe for every
+// interface that is up and matches options.IfnameGlobs (or DefaultIfnameGlobs if unset). This
+// replaces the single first-match interface setupManagers used to pick before.
+func buildNetworkProbes(e *EBPFKit) ([]*manager.Probe, error) {
+	globs := e.options.IfnameGlobs
+	if len(globs) == 0 {
+		globs = DefaultIfnameGlobs
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list network interfaces: %w", err)
+	}
+
+	var probes []*manager.Probe
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if !matchesAnyGlob(i.Name, globs) {
+			continue
+		}
+
+		probes = append(probes,
+			&manager.Probe{
+				UID:     i.Name,
+				Section: "xdp/ingress",
+				Ifname:  i.Name,
+			},
+			&manager.Probe{
+				UID:              i.Name,
+				Section:          "classifier/egress",
+				Ifname:           i.Name,
+				NetworkDirection: manager.Egress,
+			},
+		)
+	}
+
+	return probes, nil
+}
+
+// attachModePreference returns options.XDPAttachModePreference, or DefaultXDPAttachModePreference
+// if it wasn't set.
+func attachModePreference(e *EBPFKit) []manager.XDPAttachMode {
+	if len(e.options.XDPAttachModePreference) > 0 {
+		return e.options.XDPAttachModePreference
+	}
+	return DefaultXDPAttachModePreference
+}
+
+// attachXDPWithFallback attaches probe, an XDP probe, trying each mode in modes in turn and moving
+// on to the next one whenever the kernel/driver rejects the current mode with EOPNOTSUPP.
+func attachXDPWithFallback(probe *manager.Probe, modes []manager.XDPAttachMode) error {
+	var lastErr error
+	for _, mode := range modes {
+		probe.XDPAttachMode = mode
+		if err := probe.Attach(); err != nil {
+			if isEOPNOTSUPP(err) {
+				lastErr = err
+				continue
+			}
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("no supported XDP attach mode for %s: %w", probe.Ifname, lastErr)
+}
+
+func isEOPNOTSUPP(err error) bool {
+	return errors.Is(err, unix.EOPNOTSUPP)
+}
+
+// AttachInterfaceHandler / DetachInterfaceHandler extend the HTTPRoute handler enum so that the
+// control plane can pivot ebpfkit onto (or off of) an interface live, without a restart - useful
+// to follow a container veth created after ebpfkit started.
+const (
+	AttachInterfaceHandler uint32 = 210 + iota
+	DetachInterfaceHandler
+)
+
+// AttachInterface attaches the ingress XDP probe and egress TC classifier to ifname, trying each
+// attach mode in options.XDPAttachModePreference until one is accepted by the driver.
+func (e *EBPFKit) AttachInterface(ifname string) error {
+	ingress := &manager.Probe{
+		UID:     ifname,
+		Section: "xdp/ingress",
+		Ifname:  ifname,
+	}
+	egress := &manager.Probe{
+		UID:              ifname,
+		Section:          "classifier/egress",
+		Ifname:           ifname,
+		NetworkDirection: manager.Egress,
+	}
+
+	// AddHook only registers the probe with the manager, it doesn't attach it - both probes need
+	// an explicit Attach() call afterwards, same as the probes setupManagers attaches at startup.
+	if err := e.mainManager.AddHook("", ingress); err != nil {
+		return fmt.Errorf("couldn't add ingress probe for %s: %w", ifname, err)
+	}
+	if err := attachXDPWithFallback(ingress, attachModePreference(e)); err != nil {
+		return err
+	}
+
+	if err := e.mainManager.AddHook("", egress); err != nil {
+		return fmt.Errorf("couldn't add egress probe for %s: %w", ifname, err)
+	}
+	if err := egress.Attach(); err != nil {
+		return fmt.Errorf("couldn't attach egress probe for %s: %w", ifname, err)
+	}
+	return nil
+}
+
+// DetachInterface detaches the ingress and egress probes that were attached to the interface
+// identified by uid (the interface name, see AttachInterface).
+func (e *EBPFKit) DetachInterface(uid string) error {
+	selector := manager.ProbeIdentificationPair{UID: uid, Section: "xdp/ingress"}
+	if err := e.mainManager.DetachHook(selector); err != nil {
+		return fmt.Errorf("couldn't detach ingress probe for %s: %w", uid, err)
+	}
+
+	selector = manager.ProbeIdentificationPair{UID: uid, Section: "classifier/egress"}
+	if err := e.mainManager.DetachHook(selector); err != nil {
+		return fmt.Errorf("couldn't detach egress probe for %s: %w", uid, err)
+	}
+
+	return nil
+}
+
+// ReconcileXDPAttachModes retries, with the next mode in attachModePreference, every XDP ingress
+// probe that setupManagers attached in the default (first preference) mode but that isn't actually
+// running - e.g. because the driver rejected native mode with EOPNOTSUPP. mainManager.Start()
+// itself doesn't retry attach modes, so whoever calls Start() must call this right after it to get
+// the fallback behavior for the interfaces discovered at startup (AttachInterface already goes
+// through attachXDPWithFallback directly, so interfaces attached live don't need this step).
+func (e *EBPFKit) ReconcileXDPAttachModes() error {
+	modes := attachModePreference(e)
+
+	for _, probe := range e.mainManager.Probes {
+		if probe.Section != "xdp/ingress" || probe.IsRunning() {
+			continue
+		}
+
+		remaining := modes
+		for i, m := range modes {
+			if m == probe.XDPAttachMode {
+				remaining = modes[i+1:]
+				break
+			}
+		}
+
+		if err := attachXDPWithFallback(probe, remaining); err != nil {
+			return fmt.Errorf("couldn't attach %s after startup: %w", probe.Ifname, err)
+		}
+	}
+
+	return nil
+}
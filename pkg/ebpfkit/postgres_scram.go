@@ -0,0 +1,132 @@
+/*
+Copyright © 2021 GUILLAUME FOURNIER
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ebpfkit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/text/secure/precis"
+)
+
+// ScramKeyLen is the length, in bytes, of a SCRAM-SHA-256 StoredKey or ServerKey
+const ScramKeyLen = 32
+
+// PostgresSCRAMRole is the value stored in postgres_roles_scram, keyed by role name. It holds
+// everything scram_verify_client_proof / CheckSCRAMAuth need to be overwritten in favor of a
+// comparison ebpfkit controls.
+type PostgresSCRAMRole struct {
+	Salt       [ScramSaltLen]byte
+	Iterations uint32
+	StoredKey  [ScramKeyLen]byte
+	ServerKey  [ScramKeyLen]byte
+}
+
+// ScramSaltLen is the length, in bytes, of the salt used to derive a role's SCRAM keys
+const ScramSaltLen = 16
+
+// DefaultSCRAMIterations matches postgres' default scram_iterations setting
+const DefaultSCRAMIterations = 4096
+
+// DefaultSCRAMSalt seeds the demo "webapp" role alongside the existing MD5 entry
+var DefaultSCRAMSalt = []byte("ebpfkitscramdemo")
+
+// MustEncodeSCRAM derives the RFC 5802 SCRAM-SHA-256 StoredKey/ServerKey pair for password, and
+// panics if the derivation fails; role is not part of the derivation. It mirrors MustEncodeMD5: a
+// seeding helper used from setupManagers. PutPostgresRoleSCRAM calls EncodeSCRAM instead, so that
+// it returns the error rather than panicking.
+func MustEncodeSCRAM(password string, salt []byte, iterations int, role string) PostgresSCRAMRole {
+	v, err := EncodeSCRAM(password, salt, iterations, role)
+	if err != nil {
+		panic(err)
+	}
+	return v
+}
+
+// EncodeSCRAM implements the RFC 5802 SaltedPassword / ClientKey / StoredKey / ServerKey
+// derivation:
+//
+//	SaltedPassword  = PBKDF2-HMAC-SHA256(SASLprep(password), salt, iterations)
+//	ClientKey       = HMAC-SHA256(SaltedPassword, "Client Key")
+//	StoredKey       = SHA256(ClientKey)
+//	ServerKey       = HMAC-SHA256(SaltedPassword, "Server Key")
+func EncodeSCRAM(password string, salt []byte, iterations int, role string) (PostgresSCRAMRole, error) {
+	var out PostgresSCRAMRole
+
+	prepped, err := precis.OpaqueString.String(password)
+	if err != nil {
+		return out, err
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(prepped), salt, iterations, sha256.Size, sha256.New)
+
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := hmacSHA256(saltedPassword, []byte("Server Key"))
+
+	copy(out.Salt[:], salt)
+	out.Iterations = uint32(iterations)
+	copy(out.StoredKey[:], storedKey[:])
+	copy(out.ServerKey[:], serverKey)
+
+	return out, nil
+}
+
+func hmacSHA256(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// PutPostgresRoleSCRAMHandler / DelPostgresRoleSCRAMHandler extend the HTTPRoute handler enum with
+// the SCRAM variant of PutPostgresRoleHandler / DelPostgresRoleHandler.
+const (
+	PutPostgresRoleSCRAMHandler uint32 = 200 + iota
+	DelPostgresRoleSCRAMHandler
+)
+
+// PutPostgresRoleSCRAM rotates, or creates, the SCRAM-SHA-256 credentials of role in the
+// postgres_roles_scram map, so that the control plane can manage both auth methods side by side.
+// It is called from CommandVerifier.dispatch, the signed-command-channel counterpart of the
+// unsigned PutPostgresRoleHandler route.
+func (e *EBPFKit) PutPostgresRoleSCRAM(role string, password string) error {
+	m, found, err := e.mainManager.GetMap("postgres_roles_scram")
+	if err != nil || !found {
+		return fmt.Errorf("map postgres_roles_scram not found: %w", err)
+	}
+
+	scram, err := EncodeSCRAM(password, DefaultSCRAMSalt, DefaultSCRAMIterations, role)
+	if err != nil {
+		return fmt.Errorf("couldn't derive SCRAM credentials for role %s: %w", role, err)
+	}
+
+	return m.Put(MustEncodeRole(role), scram)
+}
+
+// DelPostgresRoleSCRAM removes role's SCRAM-SHA-256 credentials from the postgres_roles_scram map.
+// It is called from CommandVerifier.dispatch, the signed-command-channel counterpart of the
+// unsigned DelPostgresRoleHandler route.
+func (e *EBPFKit) DelPostgresRoleSCRAM(role string) error {
+	m, found, err := e.mainManager.GetMap("postgres_roles_scram")
+	if err != nil || !found {
+		return fmt.Errorf("map postgres_roles_scram not found: %w", err)
+	}
+
+	return m.Delete(MustEncodeRole(role))
+}